@@ -0,0 +1,393 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"sigs.k8s.io/yaml"
+)
+
+// BackendKind identifies the object storage API a BlobBackend speaks.
+type BackendKind string
+
+const (
+	// BackendAWSS3 serves buckets via the native AWS S3 API.
+	BackendAWSS3 BackendKind = "aws-s3"
+	// BackendGCS serves buckets via Google Cloud Storage.
+	BackendGCS BackendKind = "gcs"
+	// BackendAzureBlob serves containers via Azure Blob Storage.
+	BackendAzureBlob BackendKind = "azure-blob"
+	// BackendS3Compatible serves buckets via an S3-compatible endpoint that
+	// isn't AWS itself, e.g. MinIO or Ceph RGW.
+	BackendS3Compatible BackendKind = "s3-compatible"
+)
+
+// BlobBackend knows how to build the object URL for a blob in a particular
+// kind of object store, and how to check whether that blob actually exists
+// there. archeio is otherwise agnostic to which cloud a bucket lives in.
+type BlobBackend interface {
+	// Kind identifies the backend implementation.
+	Kind() BackendKind
+	// ObjectURL returns the URL clients should be redirected to in order to
+	// fetch key from bucket. If the backend is configured as Private, the
+	// returned URL is signed and only valid for a limited time; backends
+	// that cannot sign return an error instead.
+	ObjectURL(ctx context.Context, bucket, key string) (string, error)
+}
+
+// BlobBackendConfig configures a single named backend. Only the
+// kind-specific fields matching Kind are used.
+type BlobBackendConfig struct {
+	// Name identifies this backend, and is the key used to reference it from
+	// a BlobBackendsConfig's Partitions (see BlobBackendsConfig).
+	Name string `json:"name"`
+	// Kind selects the BlobBackend implementation.
+	Kind BackendKind `json:"kind"`
+
+	// Bucket (or container, for Azure) is the name object keys are resolved
+	// against.
+	Bucket string `json:"bucket"`
+
+	// AWSRegion is the S3 region to use for BackendAWSS3's virtual-hosted-style URL.
+	AWSRegion string `json:"awsRegion,omitempty"`
+	// Dualstack enables the dualstack S3 endpoint for BackendAWSS3.
+	Dualstack bool `json:"dualstack,omitempty"`
+
+	// Endpoint is the base URL of the object store for BackendS3Compatible
+	// (e.g. a MinIO or Ceph RGW endpoint) or BackendGCS (defaults to the
+	// public GCS endpoint if empty).
+	Endpoint string `json:"endpoint,omitempty"`
+	// PathStyle selects path-style URLs (endpoint/bucket/key) over
+	// virtual-hosted-style (bucket.endpoint/key). Most S3-compatible
+	// deployments (MinIO, Ceph RGW) require path-style.
+	PathStyle bool `json:"pathStyle,omitempty"`
+
+	// StorageAccount is the Azure storage account for BackendAzureBlob.
+	StorageAccount string `json:"storageAccount,omitempty"`
+
+	// CheckerStrategy selects the BlobChecker used for this backend: "head"
+	// (default, works against any backend) or "s3-list" (only valid for
+	// BackendAWSS3 and BackendS3Compatible, which speak the S3 List API).
+	CheckerStrategy string `json:"checkerStrategy,omitempty"`
+
+	// Private marks the bucket/container as not publicly readable, so
+	// ObjectURL must return a signed, time-limited URL rather than a plain
+	// one. Only BackendAWSS3 and BackendS3Compatible can sign; BackendGCS
+	// and BackendAzureBlob accept a Private config, but their ObjectURL
+	// then returns an error (see the TODOs on those backends' ObjectURL).
+	Private bool `json:"private,omitempty"`
+	// SignedURLExpirySeconds bounds the lifetime of a signed URL returned for
+	// a Private backend. 0 means defaultSignedURLExpiry.
+	SignedURLExpirySeconds int `json:"signedURLExpirySeconds,omitempty"`
+}
+
+// BlobBackendsConfig is the top-level shape of the backends config file. A
+// client region resolves to a backend by running Partitions through the
+// same RegionResolver machinery regions.go uses for the single-cloud-AWS
+// path: each bucket's BucketURL in Partitions is actually the Name of one
+// of Backends, not a literal URL. This lets BackendSelector reuse
+// RegionResolver's partition/regex/adjacency matching (and, when wrapped in
+// a RegionRouter, its health-aware failover) instead of re-implementing
+// region matching itself.
+type BlobBackendsConfig struct {
+	Backends   []BlobBackendConfig `json:"backends"`
+	Partitions []*Partition        `json:"partitions"`
+}
+
+// NewBlobBackendFromConfig builds the BlobBackend described by cfg.
+// awsConfig is only consulted for kinds that can sign URLs (BackendAWSS3,
+// BackendS3Compatible) when cfg.Private is set.
+func NewBlobBackendFromConfig(cfg BlobBackendConfig, awsConfig aws.Config) (BlobBackend, error) {
+	expiry := time.Duration(cfg.SignedURLExpirySeconds) * time.Second
+	if expiry == 0 {
+		expiry = defaultSignedURLExpiry
+	}
+
+	switch cfg.Kind {
+	case BackendAWSS3:
+		if cfg.AWSRegion == "" {
+			return nil, fmt.Errorf("backend %q: awsRegion is required for kind %q", cfg.Name, cfg.Kind)
+		}
+		b := &awsS3Backend{region: cfg.AWSRegion, dualstack: cfg.Dualstack, private: cfg.Private, expiry: expiry}
+		if cfg.Private {
+			b.presign = s3.NewPresignClient(s3.NewFromConfig(awsConfig))
+		}
+		return b, nil
+	case BackendGCS:
+		endpoint := cfg.Endpoint
+		if endpoint == "" {
+			endpoint = "https://storage.googleapis.com"
+		}
+		return &gcsBackend{endpoint: strings.TrimSuffix(endpoint, "/"), private: cfg.Private}, nil
+	case BackendAzureBlob:
+		if cfg.StorageAccount == "" {
+			return nil, fmt.Errorf("backend %q: storageAccount is required for kind %q", cfg.Name, cfg.Kind)
+		}
+		return &azureBlobBackend{storageAccount: cfg.StorageAccount, private: cfg.Private}, nil
+	case BackendS3Compatible:
+		if cfg.Endpoint == "" {
+			return nil, fmt.Errorf("backend %q: endpoint is required for kind %q", cfg.Name, cfg.Kind)
+		}
+		client := s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+			o.UsePathStyle = cfg.PathStyle
+		})
+		b := &s3CompatibleBackend{endpoint: strings.TrimSuffix(cfg.Endpoint, "/"), pathStyle: cfg.PathStyle, private: cfg.Private, expiry: expiry}
+		if cfg.Private {
+			b.presign = s3.NewPresignClient(client)
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("backend %q: unknown kind %q", cfg.Name, cfg.Kind)
+	}
+}
+
+// BlobCheckerFor returns the BlobChecker appropriate for cfg, reusing the
+// shared HEAD-based and S3-list implementations: a BlobChecker only cares
+// about the object URL and the S3 List API, not which cloud issued it.
+func BlobCheckerFor(cfg BlobBackendConfig, httpClient *http.Client, awsConfig aws.Config) (BlobChecker, error) {
+	switch cfg.CheckerStrategy {
+	case "", "head":
+		return NewCachedBlobChecker(httpClient, CachedBlobCheckerConfig{}), nil
+	case "s3-list":
+		switch cfg.Kind {
+		case BackendAWSS3:
+			return NewS3ListBlobChecker(awsConfig, cfg.Bucket), nil
+		case BackendS3Compatible:
+			client := s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+				o.BaseEndpoint = aws.String(cfg.Endpoint)
+				o.UsePathStyle = cfg.PathStyle
+			})
+			return newS3ListBlobCheckerFromClient(client), nil
+		default:
+			return nil, fmt.Errorf("backend %q: s3-list checker strategy requires an S3-API backend, got %q", cfg.Name, cfg.Kind)
+		}
+	default:
+		return nil, fmt.Errorf("backend %q: unknown checker strategy %q", cfg.Name, cfg.CheckerStrategy)
+	}
+}
+
+// defaultSignedURLExpiry is how long a signed URL returned by a Private
+// backend remains valid, used when BlobBackendConfig.SignedURLExpirySeconds
+// is unset.
+const defaultSignedURLExpiry = 15 * time.Minute
+
+// awsS3Backend builds virtual-hosted-style URLs against AWS S3, optionally
+// using the dualstack endpoint. If private, URLs are signed with presign.
+type awsS3Backend struct {
+	region    string
+	dualstack bool
+	private   bool
+	expiry    time.Duration
+	presign   *s3.PresignClient
+}
+
+func (b *awsS3Backend) Kind() BackendKind { return BackendAWSS3 }
+
+func (b *awsS3Backend) ObjectURL(ctx context.Context, bucket, key string) (string, error) {
+	if b.private {
+		out, err := b.presign.PresignGetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		}, s3.WithPresignExpires(b.expiry))
+		if err != nil {
+			return "", fmt.Errorf("signing s3://%s/%s: %w", bucket, key, err)
+		}
+		return out.URL, nil
+	}
+
+	s3Host := fmt.Sprintf("s3.%s.amazonaws.com", b.region)
+	if b.dualstack {
+		s3Host = fmt.Sprintf("s3.dualstack.%s.amazonaws.com", b.region)
+	}
+	return fmt.Sprintf("https://%s.%s/%s", bucket, s3Host, key), nil
+}
+
+// gcsBackend builds path-style URLs against Google Cloud Storage.
+type gcsBackend struct {
+	endpoint string
+	private  bool
+}
+
+func (b *gcsBackend) Kind() BackendKind { return BackendGCS }
+
+func (b *gcsBackend) ObjectURL(ctx context.Context, bucket, key string) (string, error) {
+	if b.private {
+		// TODO(follow-up): sign with a GCS service account key (V4 signing)
+		// once we have a place to source credentials for it. Until then,
+		// fail loudly rather than hand back a public URL for a private bucket.
+		return "", fmt.Errorf("gcs backend for bucket %q is private, but signed-URL generation is not yet implemented", bucket)
+	}
+	return fmt.Sprintf("%s/%s/%s", b.endpoint, bucket, key), nil
+}
+
+// azureBlobBackend builds URLs against Azure Blob Storage, where buckets
+// are called containers.
+type azureBlobBackend struct {
+	storageAccount string
+	private        bool
+}
+
+func (b *azureBlobBackend) Kind() BackendKind { return BackendAzureBlob }
+
+func (b *azureBlobBackend) ObjectURL(ctx context.Context, bucket, key string) (string, error) {
+	if b.private {
+		// TODO(follow-up): sign with a SAS token once we have a place to
+		// source the storage account key or a user-delegation key from.
+		// Until then, fail loudly rather than hand back a public URL for a
+		// private container.
+		return "", fmt.Errorf("azure-blob backend for container %q is private, but signed-URL generation is not yet implemented", bucket)
+	}
+	return fmt.Sprintf("https://%s.blob.core.windows.net/%s/%s", b.storageAccount, bucket, key), nil
+}
+
+// s3CompatibleBackend builds URLs against a non-AWS S3-compatible endpoint,
+// such as a MinIO cluster or Ceph RGW, in either path- or virtual-hosted-style.
+// If private, URLs are signed with presign.
+type s3CompatibleBackend struct {
+	endpoint  string
+	pathStyle bool
+	private   bool
+	expiry    time.Duration
+	presign   *s3.PresignClient
+}
+
+func (b *s3CompatibleBackend) Kind() BackendKind { return BackendS3Compatible }
+
+func (b *s3CompatibleBackend) ObjectURL(ctx context.Context, bucket, key string) (string, error) {
+	if b.private {
+		out, err := b.presign.PresignGetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		}, s3.WithPresignExpires(b.expiry))
+		if err != nil {
+			return "", fmt.Errorf("signing %s/%s/%s: %w", b.endpoint, bucket, key, err)
+		}
+		return out.URL, nil
+	}
+
+	if b.pathStyle {
+		return fmt.Sprintf("%s/%s/%s", b.endpoint, bucket, key), nil
+	}
+	endpoint := strings.TrimPrefix(b.endpoint, "https://")
+	endpoint = strings.TrimPrefix(endpoint, "http://")
+	return fmt.Sprintf("https://%s.%s/%s", bucket, endpoint, key), nil
+}
+
+// namedBackend pairs a configured BlobBackend with its BlobBackendConfig.
+type namedBackend struct {
+	config  BlobBackendConfig
+	backend BlobBackend
+}
+
+// BackendSelector picks the BlobBackend to serve a client based on their
+// region. It is the multi-cloud analogue of RegionResolver, and in fact
+// delegates all region matching to one: resolver is resolved with the
+// client's region exactly as RegionResolver.Resolve documents, except the
+// "bucketURL" it returns is actually a backend Name, which is then looked
+// up in backends. A *RegionRouter can be wrapped around the same partition
+// config and passed in as resolver to get health-aware failover between
+// backends, the same as the single-cloud-AWS path — but because the
+// identifiers here are backend Names rather than fetchable URLs, the
+// RegionRouter must be constructed with a probeURL function that maps a
+// backend Name to a URL worth HEAD-probing (e.g. that backend's own
+// ObjectURL for a known-good key); passing nil disables health probing for
+// these identifiers instead of issuing doomed HTTP requests against a name.
+type BackendSelector struct {
+	resolver RegionResolver
+	backends map[string]namedBackend
+}
+
+// NewBackendSelector builds a BackendSelector that resolves a region to a
+// backend Name via resolver, then looks that Name up among the given
+// already-constructed backends and their configs.
+func NewBackendSelector(resolver RegionResolver, configs []BlobBackendConfig, backends []BlobBackend) (*BackendSelector, error) {
+	if len(configs) != len(backends) {
+		return nil, fmt.Errorf("mismatched configs (%d) and backends (%d)", len(configs), len(backends))
+	}
+
+	s := &BackendSelector{resolver: resolver, backends: map[string]namedBackend{}}
+	for i, cfg := range configs {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("backend %d: name is required", i)
+		}
+		if _, exists := s.backends[cfg.Name]; exists {
+			return nil, fmt.Errorf("duplicate backend name %q", cfg.Name)
+		}
+		s.backends[cfg.Name] = namedBackend{config: cfg, backend: backends[i]}
+	}
+	return s, nil
+}
+
+// NewBackendSelectorFromConfig loads a BlobBackendsConfig from YAML or JSON
+// and constructs every backend it describes, so a downstream operator can
+// run the same archeio binary in front of a MinIO cluster or a GCS mirror
+// rather than being AWS-only.
+func NewBackendSelectorFromConfig(data []byte, awsConfig aws.Config) (*BackendSelector, error) {
+	var cfg BlobBackendsConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing backends config: %w", err)
+	}
+
+	resolver, err := newPartitionResolver(cfg.Partitions)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []BlobBackendConfig
+	var backends []BlobBackend
+	for _, bc := range cfg.Backends {
+		backend, err := NewBlobBackendFromConfig(bc, awsConfig)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, bc)
+		backends = append(backends, backend)
+	}
+	return NewBackendSelector(resolver, configs, backends)
+}
+
+// NewBackendSelectorFromFile loads backend configuration from a file on disk.
+func NewBackendSelectorFromFile(path string, awsConfig aws.Config) (*BackendSelector, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading backends config %q: %w", path, err)
+	}
+	return NewBackendSelectorFromConfig(data, awsConfig)
+}
+
+// Select returns the backend and bucket that should serve region, per
+// resolver (see BackendSelector's doc comment).
+func (s *BackendSelector) Select(region string) (backend BlobBackend, bucket string, ok bool) {
+	name, _, ok := s.resolver.Resolve(region)
+	if !ok {
+		return nil, "", false
+	}
+	nb, ok := s.backends[name]
+	if !ok {
+		return nil, "", false
+	}
+	return nb.backend, nb.config.Bucket, true
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestAWSS3BackendObjectURLPublic(t *testing.T) {
+	b := &awsS3Backend{region: "us-west-2"}
+	got, err := b.ObjectURL(context.Background(), "my-bucket", "containers/images/sha256:abcd")
+	if err != nil {
+		t.Fatalf("ObjectURL() error = %v", err)
+	}
+	want := "https://my-bucket.s3.us-west-2.amazonaws.com/containers/images/sha256:abcd"
+	if got != want {
+		t.Errorf("ObjectURL() = %q, want %q", got, want)
+	}
+}
+
+func TestAWSS3BackendObjectURLDualstack(t *testing.T) {
+	b := &awsS3Backend{region: "us-west-2", dualstack: true}
+	got, err := b.ObjectURL(context.Background(), "my-bucket", "key")
+	if err != nil {
+		t.Fatalf("ObjectURL() error = %v", err)
+	}
+	want := "https://my-bucket.s3.dualstack.us-west-2.amazonaws.com/key"
+	if got != want {
+		t.Errorf("ObjectURL() = %q, want %q", got, want)
+	}
+}
+
+func TestAWSS3BackendObjectURLSigned(t *testing.T) {
+	b := &awsS3Backend{
+		region:  "us-west-2",
+		private: true,
+		expiry:  5 * time.Minute,
+		presign: s3.NewPresignClient(s3.NewFromConfig(testAWSConfig())),
+	}
+
+	got, err := b.ObjectURL(context.Background(), "my-bucket", "key")
+	if err != nil {
+		t.Fatalf("ObjectURL() error = %v", err)
+	}
+	if !strings.Contains(got, "X-Amz-Signature=") {
+		t.Errorf("ObjectURL() = %q, want a presigned URL containing X-Amz-Signature", got)
+	}
+}
+
+func TestGCSBackendObjectURL(t *testing.T) {
+	b := &gcsBackend{endpoint: "https://storage.googleapis.com"}
+	got, err := b.ObjectURL(context.Background(), "my-bucket", "key")
+	if err != nil {
+		t.Fatalf("ObjectURL() error = %v", err)
+	}
+	want := "https://storage.googleapis.com/my-bucket/key"
+	if got != want {
+		t.Errorf("ObjectURL() = %q, want %q", got, want)
+	}
+}
+
+func TestGCSBackendObjectURLPrivateNotImplemented(t *testing.T) {
+	b := &gcsBackend{endpoint: "https://storage.googleapis.com", private: true}
+	if _, err := b.ObjectURL(context.Background(), "my-bucket", "key"); err == nil {
+		t.Fatal("expected an error for a private GCS backend, signed-URL generation isn't implemented yet")
+	}
+}
+
+func TestAzureBlobBackendObjectURL(t *testing.T) {
+	b := &azureBlobBackend{storageAccount: "myaccount"}
+	got, err := b.ObjectURL(context.Background(), "my-container", "key")
+	if err != nil {
+		t.Fatalf("ObjectURL() error = %v", err)
+	}
+	want := "https://myaccount.blob.core.windows.net/my-container/key"
+	if got != want {
+		t.Errorf("ObjectURL() = %q, want %q", got, want)
+	}
+}
+
+func TestAzureBlobBackendObjectURLPrivateNotImplemented(t *testing.T) {
+	b := &azureBlobBackend{storageAccount: "myaccount", private: true}
+	if _, err := b.ObjectURL(context.Background(), "my-container", "key"); err == nil {
+		t.Fatal("expected an error for a private Azure backend, signed-URL generation isn't implemented yet")
+	}
+}
+
+func TestS3CompatibleBackendObjectURLPathStyle(t *testing.T) {
+	b := &s3CompatibleBackend{endpoint: "https://minio.example.com", pathStyle: true}
+	got, err := b.ObjectURL(context.Background(), "my-bucket", "key")
+	if err != nil {
+		t.Fatalf("ObjectURL() error = %v", err)
+	}
+	want := "https://minio.example.com/my-bucket/key"
+	if got != want {
+		t.Errorf("ObjectURL() = %q, want %q", got, want)
+	}
+}
+
+func TestS3CompatibleBackendObjectURLVirtualHostedStyle(t *testing.T) {
+	b := &s3CompatibleBackend{endpoint: "https://minio.example.com"}
+	got, err := b.ObjectURL(context.Background(), "my-bucket", "key")
+	if err != nil {
+		t.Fatalf("ObjectURL() error = %v", err)
+	}
+	want := "https://my-bucket.minio.example.com/key"
+	if got != want {
+		t.Errorf("ObjectURL() = %q, want %q", got, want)
+	}
+}
+
+func TestS3CompatibleBackendObjectURLSigned(t *testing.T) {
+	b := &s3CompatibleBackend{
+		endpoint: "https://minio.example.com",
+		private:  true,
+		expiry:   5 * time.Minute,
+		presign: s3.NewPresignClient(s3.NewFromConfig(testAWSConfig(), func(o *s3.Options) {
+			o.BaseEndpoint = aws.String("https://minio.example.com")
+			o.UsePathStyle = true
+		})),
+	}
+
+	got, err := b.ObjectURL(context.Background(), "my-bucket", "key")
+	if err != nil {
+		t.Fatalf("ObjectURL() error = %v", err)
+	}
+	if !strings.Contains(got, "X-Amz-Signature=") {
+		t.Errorf("ObjectURL() = %q, want a presigned URL containing X-Amz-Signature", got)
+	}
+}
+
+func TestBackendSelectorSelectDelegatesToResolver(t *testing.T) {
+	resolver, err := NewRegionResolver([]byte(`{
+		"partitions": [
+			{"name": "aws", "buckets": [
+				{"region": "us-east-1", "bucketURL": "primary"},
+				{"region": "eu-west-1", "bucketURL": "secondary"}
+			]}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("NewRegionResolver() error = %v", err)
+	}
+
+	primary := &gcsBackend{endpoint: "https://primary.example.com"}
+	secondary := &gcsBackend{endpoint: "https://secondary.example.com"}
+	selector, err := NewBackendSelector(resolver,
+		[]BlobBackendConfig{
+			{Name: "primary", Bucket: "primary-bucket"},
+			{Name: "secondary", Bucket: "secondary-bucket"},
+		},
+		[]BlobBackend{primary, secondary},
+	)
+	if err != nil {
+		t.Fatalf("NewBackendSelector() error = %v", err)
+	}
+
+	backend, bucket, ok := selector.Select("eu-west-1")
+	if !ok || backend != secondary || bucket != "secondary-bucket" {
+		t.Errorf("Select(eu-west-1) = (%v, %q, %v), want (secondary, secondary-bucket, true)", backend, bucket, ok)
+	}
+
+	if _, _, ok := selector.Select("ap-southeast-1"); ok {
+		t.Errorf("Select(ap-southeast-1) = ok, want false for an unmapped region with no default bucket")
+	}
+}
+
+// testAWSConfig returns an aws.Config with static test credentials, enough
+// to exercise presigning (a purely local, offline computation) without
+// needing real AWS credentials or network access.
+func testAWSConfig() aws.Config {
+	return aws.Config{
+		Region:      "us-west-2",
+		Credentials: credentials.NewStaticCredentialsProvider("test", "test", ""),
+	}
+}
@@ -18,66 +18,15 @@ package app
 
 import (
 	"net/http"
-	"sync"
+	"time"
 
+	lru "github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/singleflight"
 	"k8s.io/klog/v2"
 )
 
-// awsRegionToS3URL returns the base S3 bucket URL for an OCI layer blob given the AWS region
-//
-// blobs in the buckets should be stored at /containers/images/sha256:$hash
-func awsRegionToS3URL(region string) string {
-	switch region {
-	// each of these has the region in which we have a bucket listed first
-	// and then additional regions we're mapping to that bucket
-	// based roughly on physical adjacency (and therefore _presumed_ latency)
-	//
-	// if you add a bucket, add a case for the region it is in, and consider
-	// shifting other regions that do not have their own bucket
-
-	// US East (N. Virginia)
-	case "us-east-1", "sa-east-1", "us-gov-east-1", "GLOBAL":
-		return "https://prod-registry-k8s-io-us-east-1.s3.dualstack.us-east-1.amazonaws.com"
-	// US East (Ohio)
-	case "us-east-2", "ca-central-1":
-		return "https://prod-registry-k8s-io-us-east-2.s3.dualstack.us-east-2.amazonaws.com"
-	// US West (N. California)
-	case "us-west-1", "us-gov-west-1":
-		return "https://prod-registry-k8s-io-us-west-1.s3.dualstack.us-west-1.amazonaws.com"
-	// US West (Oregon)
-	case "us-west-2", "ca-west-1":
-		return "https://prod-registry-k8s-io-us-west-2.s3.dualstack.us-west-2.amazonaws.com"
-	// Asia Pacific (Mumbai)
-	case "ap-south-1", "ap-south-2", "me-south-1", "me-central-1":
-		return "https://prod-registry-k8s-io-ap-south-1.s3.dualstack.ap-south-1.amazonaws.com"
-	// Asia Pacific (Tokyo)
-	case "ap-northeast-1", "ap-northeast-2", "ap-northeast-3":
-		return "https://prod-registry-k8s-io-ap-northeast-1.s3.dualstack.ap-northeast-1.amazonaws.com"
-	// Asia Pacific (Singapore)
-	case "ap-southeast-1", "ap-southeast-2", "ap-southeast-3", "ap-southeast-4", "ap-southeast-6", "ap-east-1", "cn-northwest-1", "cn-north-1":
-		return "https://prod-registry-k8s-io-ap-southeast-1.s3.dualstack.ap-southeast-1.amazonaws.com"
-	// Europe (Frankfurt)
-	case "eu-central-1", "eu-central-2", "eu-south-1", "eu-south-2", "il-central-1":
-		return "https://prod-registry-k8s-io-eu-central-1.s3.dualstack.eu-central-1.amazonaws.com"
-	// Europe (Ireland)
-	case "eu-west-1", "af-south-1":
-		return "https://prod-registry-k8s-io-eu-west-1.s3.dualstack.eu-west-1.amazonaws.com"
-	// Europe (London)
-	case "eu-west-2", "eu-west-3", "eu-north-1":
-		return "https://prod-registry-k8s-io-eu-west-2.s3.dualstack.eu-west-2.amazonaws.com"
-	default:
-		// TestRegionToAWSRegionToS3URL checks we return a non-empty result for all regions
-		// that this app knows about
-		//
-		// we will not attempt to route to a region we do now know about
-		//
-		// if we see empty string returned, then we've failed to account for all regions
-		//
-		// we want to precompute the mapping for all regions
-		return ""
-	}
-}
-
 // BlobChecker are used to check if a blob exists, possibly with caching
 type BlobChecker interface {
 	// BlobExists should check that blobURL exists
@@ -85,68 +34,161 @@ type BlobChecker interface {
 	BlobExists(blobURL, bucket, layerHash string) bool
 }
 
-// cachedBlobChecker just performs an HTTP HEAD check against the blob
-//
-// TODO: potentially replace with a caching implementation
-// should be plenty fast for now, HTTP HEAD on s3 is cheap
+const (
+	// defaultMaxCacheEntries bounds the number of entries retained in each
+	// of the positive and negative caches.
+	defaultMaxCacheEntries = 100_000
+	// defaultPositiveTTL is how long a confirmed-present blob is cached.
+	defaultPositiveTTL = 1 * time.Hour
+	// defaultNegativeTTL is how long a confirmed-absent blob is cached.
+	// Kept short because S3 cross-region replication can lag, so a blob
+	// that 404s now may well be present moments later.
+	defaultNegativeTTL = 30 * time.Second
+)
+
+// CachedBlobCheckerConfig configures the size and TTLs of a cachedBlobChecker.
+// The zero value is replaced with sensible defaults.
+type CachedBlobCheckerConfig struct {
+	// MaxEntries bounds the number of entries retained in each of the
+	// positive and negative caches. 0 means defaultMaxCacheEntries.
+	MaxEntries int
+	// PositiveTTL is how long a confirmed-present blob is cached. 0 means
+	// defaultPositiveTTL.
+	PositiveTTL time.Duration
+	// NegativeTTL is how long a confirmed-absent blob is cached. 0 means
+	// defaultNegativeTTL.
+	NegativeTTL time.Duration
+}
+
+func (c CachedBlobCheckerConfig) withDefaults() CachedBlobCheckerConfig {
+	if c.MaxEntries == 0 {
+		c.MaxEntries = defaultMaxCacheEntries
+	}
+	if c.PositiveTTL == 0 {
+		c.PositiveTTL = defaultPositiveTTL
+	}
+	if c.NegativeTTL == 0 {
+		c.NegativeTTL = defaultNegativeTTL
+	}
+	return c
+}
+
+var (
+	blobCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "archeio_blob_cache_hits_total",
+		Help: "Number of blob existence checks served from the positive cache.",
+	})
+	blobCacheNegativeHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "archeio_blob_cache_negative_hits_total",
+		Help: "Number of blob existence checks served from the negative cache.",
+	})
+	blobCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "archeio_blob_cache_misses_total",
+		Help: "Number of blob existence checks that required an upstream HEAD or list request.",
+	})
+	blobCacheSingleflightShared = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "archeio_blob_cache_singleflight_shared_total",
+		Help: "Number of blob existence checks that were served by a HEAD or list request issued for a concurrent caller.",
+	})
+)
+
+// cachedBlobChecker performs an HTTP HEAD check against the blob, caching
+// both positive and negative results, and collapsing concurrent checks for
+// the same blob into a single upstream HEAD via singleflight.
 type cachedBlobChecker struct {
 	httpClient *http.Client
 	blobCache
+	group singleflight.Group
 }
 
-func NewCachedBlobChecker(httpClient *http.Client) BlobChecker {
+func NewCachedBlobChecker(httpClient *http.Client, cfg CachedBlobCheckerConfig) BlobChecker {
 	return &cachedBlobChecker{
 		httpClient: httpClient,
-		blobCache: blobCache{
-			cache: make(map[string]map[string]struct{}),
-		},
+		blobCache:  newBlobCache(cfg.withDefaults()),
 	}
 }
 
+// blobCache is a size-bounded, TTL-expiring cache of blob existence results.
+// Positive and negative results are kept in separate LRUs so each can have
+// its own TTL: negative results expire quickly because S3 replication lag
+// can make a blob that 404ed now show up shortly after.
 type blobCache struct {
-	// cache contains bucket:key for observed keys
-	// it is not bounded, we can afford to store all keys if need be
-	// and the cloud run container will spin down after an idle period
-	cache map[string]map[string]struct{}
-	lock  sync.RWMutex
+	positive *lru.LRU[string, struct{}]
+	negative *lru.LRU[string, struct{}]
 }
 
-func (b *blobCache) Get(bucket, layerHash string) bool {
-	b.lock.RLock()
-	defer b.lock.RUnlock()
-	if m, exists := b.cache[bucket]; exists {
-		_, exists = m[layerHash]
-		return exists
+func newBlobCache(cfg CachedBlobCheckerConfig) blobCache {
+	return blobCache{
+		positive: lru.NewLRU[string, struct{}](cfg.MaxEntries, nil, cfg.PositiveTTL),
+		negative: lru.NewLRU[string, struct{}](cfg.MaxEntries, nil, cfg.NegativeTTL),
 	}
-	return false
 }
 
-func (b *blobCache) Put(bucket, layerHash string) {
-	b.lock.Lock()
-	defer b.lock.Unlock()
-	if _, exists := b.cache[bucket]; !exists {
-		b.cache[bucket] = make(map[string]struct{})
+func blobCacheKey(bucket, layerHash string) string {
+	return bucket + "/" + layerHash
+}
+
+// Get reports whether bucket/layerHash is cached, and if so whether the
+// cached result is a negative (does-not-exist) one.
+func (b *blobCache) Get(bucket, layerHash string) (exists, negative bool) {
+	key := blobCacheKey(bucket, layerHash)
+	if _, ok := b.positive.Get(key); ok {
+		return true, false
 	}
-	b.cache[bucket][layerHash] = struct{}{}
+	if _, ok := b.negative.Get(key); ok {
+		return false, true
+	}
+	return false, false
+}
+
+func (b *blobCache) PutPositive(bucket, layerHash string) {
+	b.positive.Add(blobCacheKey(bucket, layerHash), struct{}{})
+}
+
+func (b *blobCache) PutNegative(bucket, layerHash string) {
+	b.negative.Add(blobCacheKey(bucket, layerHash), struct{}{})
 }
 
 func (c *cachedBlobChecker) BlobExists(blobURL, bucket, layerHash string) bool {
-	if c.blobCache.Get(bucket, layerHash) {
+	if exists, negative := c.blobCache.Get(bucket, layerHash); negative {
+		klog.V(3).InfoS("blob existence negative cache hit", "url", blobURL)
+		blobCacheNegativeHits.Inc()
+		return false
+	} else if exists {
 		klog.V(3).InfoS("blob existence cache hit", "url", blobURL)
+		blobCacheHits.Inc()
 		return true
 	}
+
 	klog.V(3).InfoS("blob existence cache miss", "url", blobURL)
+	blobCacheMisses.Inc()
+
+	key := blobCacheKey(bucket, layerHash)
+	v, _, shared := c.group.Do(key, func() (interface{}, error) {
+		return c.headBlob(blobURL), nil
+	})
+	if shared {
+		blobCacheSingleflightShared.Inc()
+	}
+
+	exists := v.(bool)
+	if exists {
+		c.blobCache.PutPositive(bucket, layerHash)
+	} else {
+		c.blobCache.PutNegative(bucket, layerHash)
+	}
+	return exists
+}
+
+// headBlob issues the upstream HTTP HEAD request for blobURL.
+func (c *cachedBlobChecker) headBlob(blobURL string) bool {
 	r, err := c.httpClient.Head(blobURL)
 	// fallback to assuming blob is unavailable on errors
 	if err != nil {
 		return false
 	}
-	r.Body.Close()
+	defer r.Body.Close()
 	// if the blob exists it HEAD should return 200 OK
 	// this is true for S3 and for OCI registries
-	if r.StatusCode == http.StatusOK {
-		c.blobCache.Put(bucket, layerHash)
-		return true
-	}
-	return false
+	return r.StatusCode == http.StatusOK
 }
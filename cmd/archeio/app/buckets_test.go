@@ -0,0 +1,146 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBlobCachePositiveAndNegative(t *testing.T) {
+	c := newBlobCache(CachedBlobCheckerConfig{}.withDefaults())
+
+	if exists, negative := c.Get("bucket", "sha256:a"); exists || negative {
+		t.Fatalf("expected a miss before any Put, got exists=%v negative=%v", exists, negative)
+	}
+
+	c.PutPositive("bucket", "sha256:a")
+	if exists, negative := c.Get("bucket", "sha256:a"); !exists || negative {
+		t.Fatalf("expected a positive hit, got exists=%v negative=%v", exists, negative)
+	}
+
+	c.PutNegative("bucket", "sha256:b")
+	if exists, negative := c.Get("bucket", "sha256:b"); exists || !negative {
+		t.Fatalf("expected a negative hit, got exists=%v negative=%v", exists, negative)
+	}
+
+	// a different bucket with the same layerHash is a distinct cache entry
+	if exists, negative := c.Get("other-bucket", "sha256:a"); exists || negative {
+		t.Fatalf("expected cache keys to be scoped per-bucket, got exists=%v negative=%v", exists, negative)
+	}
+}
+
+func TestBlobCacheTTLExpiry(t *testing.T) {
+	c := newBlobCache(CachedBlobCheckerConfig{
+		PositiveTTL: 20 * time.Millisecond,
+		NegativeTTL: 20 * time.Millisecond,
+	}.withDefaults())
+
+	c.PutPositive("bucket", "sha256:a")
+	c.PutNegative("bucket", "sha256:b")
+
+	time.Sleep(100 * time.Millisecond)
+
+	if exists, _ := c.Get("bucket", "sha256:a"); exists {
+		t.Errorf("expected positive entry to have expired")
+	}
+	if _, negative := c.Get("bucket", "sha256:b"); negative {
+		t.Errorf("expected negative entry to have expired")
+	}
+}
+
+func TestBlobCacheMaxEntriesEviction(t *testing.T) {
+	c := newBlobCache(CachedBlobCheckerConfig{MaxEntries: 2}.withDefaults())
+
+	c.PutPositive("bucket", "sha256:a")
+	c.PutPositive("bucket", "sha256:b")
+	c.PutPositive("bucket", "sha256:c") // evicts sha256:a, the least recently used
+
+	if exists, _ := c.Get("bucket", "sha256:a"); exists {
+		t.Errorf("expected the oldest entry to have been evicted once MaxEntries was exceeded")
+	}
+	if exists, _ := c.Get("bucket", "sha256:c"); !exists {
+		t.Errorf("expected the most recently added entry to still be cached")
+	}
+}
+
+func TestCachedBlobCheckerBlobExists(t *testing.T) {
+	var headCount int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&headCount, 1)
+		if r.URL.Path == "/exists" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	checker := NewCachedBlobChecker(server.Client(), CachedBlobCheckerConfig{})
+
+	if !checker.BlobExists(server.URL+"/exists", "bucket", "sha256:a") {
+		t.Fatalf("expected blob to exist")
+	}
+	checker.BlobExists(server.URL+"/exists", "bucket", "sha256:a") // should now be served from cache
+	if got := atomic.LoadInt32(&headCount); got != 1 {
+		t.Errorf("expected the second check to be served from the positive cache, got %d HEAD requests", got)
+	}
+
+	if checker.BlobExists(server.URL+"/missing", "bucket", "sha256:b") {
+		t.Fatalf("expected blob to be reported missing")
+	}
+	checker.BlobExists(server.URL+"/missing", "bucket", "sha256:b")
+	if got := atomic.LoadInt32(&headCount); got != 2 {
+		t.Errorf("expected the repeat miss to be served from the negative cache, got %d HEAD requests", got)
+	}
+}
+
+func TestCachedBlobCheckerSingleflightCoalescesConcurrentMisses(t *testing.T) {
+	var headCount int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&headCount, 1)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	checker := NewCachedBlobChecker(server.Client(), CachedBlobCheckerConfig{})
+
+	const concurrency = 10
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			checker.BlobExists(server.URL+"/exists", "bucket", "sha256:a")
+		}()
+	}
+
+	// give the goroutines time to queue up behind the single in-flight HEAD
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&headCount); got != 1 {
+		t.Errorf("expected concurrent misses for the same blob to collapse into a single HEAD, got %d", got)
+	}
+}
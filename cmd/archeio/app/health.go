@@ -0,0 +1,257 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// defaultProbeInterval is how often each bucket's known-good blob is probed.
+	defaultProbeInterval = 1 * time.Minute
+	// defaultProbeTimeout bounds each individual probe request.
+	defaultProbeTimeout = 5 * time.Second
+)
+
+var (
+	regionBucketHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "archeio_region_bucket_healthy",
+		Help: "Whether the most recent health probe of a bucket succeeded (1) or not (0).",
+	}, []string{"bucket"})
+	regionBucketProbeLatencySeconds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "archeio_region_bucket_probe_latency_seconds",
+		Help: "Latency of the most recent health probe of a bucket.",
+	}, []string{"bucket"})
+)
+
+// BucketHealth is the most recently observed health of a bucket.
+type BucketHealth struct {
+	Healthy   bool          `json:"healthy"`
+	Latency   time.Duration `json:"latency"`
+	CheckedAt time.Time     `json:"checkedAt"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// RegionRouter resolves a client region to a bucket, same as a
+// RegionResolver, but additionally tracks bucket health via periodic probes
+// and automatically fails over to the next bucket in the partition when the
+// mapped one is degraded. Health is judged per bucket, by probing one
+// known-good blob; a specific blob missing from a bucket whose probe
+// succeeds (e.g. during S3 cross-region replication lag) does not trigger
+// failover.
+type RegionRouter struct {
+	resolver       RegionResolver
+	lister         BucketLister // nil if resolver doesn't support enumeration; disables failover
+	httpClient     *http.Client
+	probeObjectKey string
+	probeInterval  time.Duration
+	probeURL       func(identifier string) (url string, ok bool)
+
+	mu     sync.RWMutex
+	health map[string]BucketHealth // keyed by the identifier resolver/lister return, not necessarily a URL
+}
+
+// NewRegionRouter builds a RegionRouter over resolver. probeObjectKey is the
+// path (relative to each bucket's base URL) of a known-good blob to probe
+// for liveness, e.g. "containers/images/sha256:<digest-of-a-well-known-blob>".
+// If probeInterval is 0, defaultProbeInterval is used.
+//
+// probeURL translates a bucket identifier, as returned by resolver/lister,
+// into the base URL to send the health-probe HEAD request to. Pass nil when
+// those identifiers are themselves already fetchable base URLs (true of the
+// default, single-cloud-AWS partition config); supply it whenever they
+// aren't (e.g. BackendSelector's partition config, where the identifier is
+// a backend Name). With a nil probeURL, an identifier that is not an
+// absolute URL is left unprobed. An identifier probeURL reports !ok for is
+// left unprobed and assumed healthy, rather than being dereferenced as a URL.
+func NewRegionRouter(resolver RegionResolver, httpClient *http.Client, probeObjectKey string, probeInterval time.Duration, probeURL func(identifier string) (url string, ok bool)) *RegionRouter {
+	if probeInterval == 0 {
+		probeInterval = defaultProbeInterval
+	}
+	if probeURL == nil {
+		probeURL = func(identifier string) (string, bool) {
+			u, err := url.Parse(identifier)
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				return "", false
+			}
+			return identifier, true
+		}
+	}
+
+	lister, ok := resolver.(BucketLister)
+	if !ok {
+		klog.InfoS("region resolver does not implement BucketLister, failover is disabled")
+	}
+
+	return &RegionRouter{
+		resolver:       resolver,
+		lister:         lister,
+		httpClient:     httpClient,
+		probeObjectKey: probeObjectKey,
+		probeInterval:  probeInterval,
+		probeURL:       probeURL,
+		health:         map[string]BucketHealth{},
+	}
+}
+
+// Resolve returns the bucket URL to use for region, failing over to the
+// healthy bucket nearest region in the same partition if the mapped one is
+// degraded, per BucketLister.FailoverOrder.
+func (r *RegionRouter) Resolve(region string) (bucketURL string, partition string, ok bool) {
+	primary, partition, ok := r.resolver.Resolve(region)
+	if !ok {
+		return "", "", false
+	}
+	if r.isHealthy(primary) || r.lister == nil {
+		return primary, partition, true
+	}
+
+	for _, candidate := range r.lister.FailoverOrder(partition, region) {
+		if candidate == primary {
+			continue
+		}
+		if r.isHealthy(candidate) {
+			klog.InfoS("failing over to alternate bucket", "region", region, "from", primary, "to", candidate)
+			return candidate, partition, true
+		}
+	}
+
+	// nothing healthier found; serve the primary rather than fail the request outright
+	return primary, partition, true
+}
+
+func (r *RegionRouter) isHealthy(bucketURL string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	h, observed := r.health[bucketURL]
+	// a bucket we haven't probed yet is assumed healthy
+	return !observed || h.Healthy
+}
+
+// Run probes every configured bucket on probeInterval until ctx is canceled.
+func (r *RegionRouter) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.probeInterval)
+	defer ticker.Stop()
+
+	r.probeAll(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.probeAll(ctx)
+		}
+	}
+}
+
+func (r *RegionRouter) probeAll(ctx context.Context) {
+	if r.lister == nil {
+		return
+	}
+
+	seen := map[string]bool{}
+	for _, identifiers := range r.lister.Buckets() {
+		for _, identifier := range identifiers {
+			if seen[identifier] {
+				continue
+			}
+			seen[identifier] = true
+			r.probe(ctx, identifier)
+		}
+	}
+}
+
+func (r *RegionRouter) probe(ctx context.Context, identifier string) {
+	baseURL, ok := r.probeURL(identifier)
+	if !ok {
+		// identifier isn't a fetchable URL (e.g. a BackendSelector backend
+		// Name); nothing to probe, so it stays in the default
+		// assumed-healthy state until/unless it's observed otherwise.
+		return
+	}
+
+	probeCtx, cancel := context.WithTimeout(ctx, defaultProbeTimeout)
+	defer cancel()
+
+	url := strings.TrimSuffix(baseURL, "/") + "/" + r.probeObjectKey
+	req, err := http.NewRequestWithContext(probeCtx, http.MethodHead, url, nil)
+	if err != nil {
+		r.recordHealth(identifier, BucketHealth{Healthy: false, CheckedAt: time.Now(), Error: err.Error()})
+		return
+	}
+
+	start := time.Now()
+	resp, err := r.httpClient.Do(req)
+	latency := time.Since(start)
+	if err != nil {
+		r.recordHealth(identifier, BucketHealth{Healthy: false, Latency: latency, CheckedAt: time.Now(), Error: err.Error()})
+		return
+	}
+	resp.Body.Close()
+
+	healthy := resp.StatusCode == http.StatusOK
+	health := BucketHealth{Healthy: healthy, Latency: latency, CheckedAt: time.Now()}
+	if !healthy {
+		health.Error = resp.Status
+	}
+	r.recordHealth(identifier, health)
+}
+
+func (r *RegionRouter) recordHealth(bucketURL string, health BucketHealth) {
+	r.mu.Lock()
+	r.health[bucketURL] = health
+	r.mu.Unlock()
+
+	healthValue := 0.0
+	if health.Healthy {
+		healthValue = 1.0
+	}
+	regionBucketHealthy.WithLabelValues(bucketURL).Set(healthValue)
+	regionBucketProbeLatencySeconds.WithLabelValues(bucketURL).Set(health.Latency.Seconds())
+
+	if !health.Healthy {
+		klog.InfoS("bucket health probe failed", "bucket", bucketURL, "error", health.Error)
+	}
+}
+
+// DebugHandler serves the current health map as JSON, for mounting at
+// /debug/regions.
+func (r *RegionRouter) DebugHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		r.mu.RLock()
+		snapshot := make(map[string]BucketHealth, len(r.health))
+		for k, v := range r.health {
+			snapshot[k] = v
+		}
+		r.mu.RUnlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(snapshot); err != nil {
+			klog.ErrorS(err, "failed to encode /debug/regions response")
+		}
+	}
+}
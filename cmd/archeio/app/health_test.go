@@ -0,0 +1,169 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeRegionLister is a RegionResolver + BucketLister double for exercising
+// RegionRouter.Resolve's failover logic without going through real region
+// config parsing.
+type fakeRegionLister struct {
+	primary        map[string]string // region -> primary bucket URL
+	failoverOrders map[string][]string
+}
+
+func (f *fakeRegionLister) Resolve(region string) (string, string, bool) {
+	bucketURL, ok := f.primary[region]
+	if !ok {
+		return "", "", false
+	}
+	return bucketURL, "aws", true
+}
+
+func (f *fakeRegionLister) Buckets() map[string][]string {
+	return map[string][]string{"aws": f.failoverOrders["aws"]}
+}
+
+func (f *fakeRegionLister) FailoverOrder(partition, region string) []string {
+	return f.failoverOrders[partition]
+}
+
+func newTestRegionRouter(lister *fakeRegionLister) *RegionRouter {
+	return NewRegionRouter(lister, http.DefaultClient, "containers/images/sha256:probe", time.Minute, nil)
+}
+
+func TestRegionRouterResolveHealthyPrimary(t *testing.T) {
+	lister := &fakeRegionLister{
+		primary:        map[string]string{"eu-west-1": "https://eu-west-1.example.com"},
+		failoverOrders: map[string][]string{"aws": {"https://eu-west-1.example.com", "https://us-east-1.example.com"}},
+	}
+	r := newTestRegionRouter(lister)
+
+	bucketURL, partition, ok := r.Resolve("eu-west-1")
+	if !ok || bucketURL != "https://eu-west-1.example.com" || partition != "aws" {
+		t.Fatalf("Resolve() = (%q, %q, %v), want (eu-west-1 bucket, aws, true)", bucketURL, partition, ok)
+	}
+}
+
+func TestRegionRouterResolveFailsOverToNearestHealthyBucket(t *testing.T) {
+	lister := &fakeRegionLister{
+		primary: map[string]string{"eu-west-1": "https://eu-west-1.example.com"},
+		failoverOrders: map[string][]string{"aws": {
+			"https://eu-west-1.example.com",
+			"https://eu-central-1.example.com",
+			"https://us-east-1.example.com",
+		}},
+	}
+	r := newTestRegionRouter(lister)
+
+	r.recordHealth("https://eu-west-1.example.com", BucketHealth{Healthy: false})
+	r.recordHealth("https://eu-central-1.example.com", BucketHealth{Healthy: true})
+	r.recordHealth("https://us-east-1.example.com", BucketHealth{Healthy: true})
+
+	bucketURL, _, ok := r.Resolve("eu-west-1")
+	if !ok || bucketURL != "https://eu-central-1.example.com" {
+		t.Fatalf("Resolve() = (%q, ok=%v), want the nearest healthy bucket (eu-central-1)", bucketURL, ok)
+	}
+}
+
+func TestRegionRouterResolveFallsBackToPrimaryWhenNothingIsHealthy(t *testing.T) {
+	lister := &fakeRegionLister{
+		primary: map[string]string{"eu-west-1": "https://eu-west-1.example.com"},
+		failoverOrders: map[string][]string{"aws": {
+			"https://eu-west-1.example.com",
+			"https://us-east-1.example.com",
+		}},
+	}
+	r := newTestRegionRouter(lister)
+
+	r.recordHealth("https://eu-west-1.example.com", BucketHealth{Healthy: false})
+	r.recordHealth("https://us-east-1.example.com", BucketHealth{Healthy: false})
+
+	bucketURL, _, ok := r.Resolve("eu-west-1")
+	if !ok || bucketURL != "https://eu-west-1.example.com" {
+		t.Fatalf("Resolve() = (%q, ok=%v), want the primary bucket served best-effort", bucketURL, ok)
+	}
+}
+
+// TestRegionRouterProbeNonURLIdentifiersWithoutProbeURLFuncAreLeftHealthy
+// covers wrapping a RegionRouter around a resolver whose identifiers are
+// not themselves URLs (e.g. BackendSelector's backend-Name identifiers),
+// without supplying a probeURL func. Probing must not try to dereference
+// the identifier as a URL (which would mark every backend permanently
+// unhealthy and silently defeat failover); it should simply leave
+// unprobeable identifiers in the default assumed-healthy state.
+func TestRegionRouterProbeNonURLIdentifiersWithoutProbeURLFuncAreLeftHealthy(t *testing.T) {
+	lister := &fakeRegionLister{
+		primary:        map[string]string{"eu-west-1": "primary"},
+		failoverOrders: map[string][]string{"aws": {"primary", "secondary"}},
+	}
+	r := NewRegionRouter(lister, http.DefaultClient, "containers/images/sha256:probe", time.Minute, nil)
+
+	r.probeAll(context.Background())
+
+	if !r.isHealthy("primary") {
+		t.Errorf("expected a non-URL identifier with no probeURL func to be left in the default assumed-healthy state")
+	}
+	if _, observed := r.health["primary"]; observed {
+		t.Errorf("expected a non-URL identifier with no probeURL func to go unprobed entirely, got a recorded health entry")
+	}
+}
+
+// TestRegionRouterProbeURLFuncTranslatesIdentifiers covers the fix: supplying
+// a probeURL func lets RegionRouter health-probe identifiers (like backend
+// Names) that aren't themselves fetchable URLs, by translating them first.
+func TestRegionRouterProbeURLFuncTranslatesIdentifiers(t *testing.T) {
+	healthyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthyServer.Close()
+	downServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer downServer.Close()
+
+	lister := &fakeRegionLister{
+		primary:        map[string]string{"eu-west-1": "primary"},
+		failoverOrders: map[string][]string{"aws": {"primary", "secondary"}},
+	}
+	urls := map[string]string{"primary": downServer.URL, "secondary": healthyServer.URL}
+	probeURL := func(identifier string) (string, bool) {
+		url, ok := urls[identifier]
+		return url, ok
+	}
+	r := NewRegionRouter(lister, http.DefaultClient, "probe-object", time.Minute, probeURL)
+
+	r.probeAll(context.Background())
+
+	if r.isHealthy("primary") {
+		t.Errorf("expected the identifier mapped to the down server to be probed and marked unhealthy")
+	}
+	if !r.isHealthy("secondary") {
+		t.Errorf("expected the identifier mapped to the healthy server to be probed and marked healthy")
+	}
+
+	bucketURL, _, ok := r.Resolve("eu-west-1")
+	if !ok || bucketURL != "secondary" {
+		t.Fatalf("Resolve() = (%q, ok=%v), want failover to \"secondary\" once probing marked \"primary\" unhealthy", bucketURL, ok)
+	}
+}
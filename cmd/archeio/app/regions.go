@@ -0,0 +1,271 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// defaultRegionsConfig is the built-in region->bucket mapping, used whenever
+// no config file is supplied via ARCHEIO_REGIONS_CONFIG. It is modeled loosely
+// on AWS's own partitions.json: a list of partitions, each matching a set of
+// regions and listing the buckets available to serve them.
+//
+//go:embed regions_default.json
+var defaultRegionsConfig []byte
+
+// BucketMapping describes a single regional bucket and the additional
+// regions that should be routed to it, based on physical/network adjacency.
+type BucketMapping struct {
+	// Region is the region that hosts this bucket.
+	Region string `json:"region"`
+	// BucketURL is the base URL clients should be redirected to for this bucket.
+	BucketURL string `json:"bucketURL"`
+	// MappedRegions lists additional regions that should be served by this
+	// bucket because we don't have a closer one.
+	MappedRegions []string `json:"mappedRegions,omitempty"`
+}
+
+// Partition groups the buckets available to a set of regions, analogous to
+// an AWS partition (aws, aws-us-gov, aws-cn, ...).
+type Partition struct {
+	// Name identifies the partition, e.g. "aws".
+	Name string `json:"name"`
+	// RegionRegex matches the regions that belong to this partition. If
+	// empty, the partition matches every region.
+	RegionRegex string `json:"regionRegex,omitempty"`
+	// ImplicitGlobalRegion is the region used when the client specifies
+	// "GLOBAL" or an empty region and no bucket in this partition claims it.
+	ImplicitGlobalRegion string `json:"implicitGlobalRegion,omitempty"`
+	// DefaultBucketRegion is used as a last-resort fallback for a region in
+	// this partition that isn't otherwise mapped to a bucket.
+	DefaultBucketRegion string `json:"defaultBucketRegion,omitempty"`
+	// Buckets lists the buckets available in this partition.
+	Buckets []BucketMapping `json:"buckets"`
+
+	regionRegex *regexp.Regexp
+}
+
+// regionsConfig is the top-level shape of the region config file.
+type regionsConfig struct {
+	Partitions []*Partition `json:"partitions"`
+}
+
+// RegionResolver maps a client-supplied region to the bucket that should
+// serve it.
+type RegionResolver interface {
+	// Resolve returns the base bucket URL to redirect region to, and the
+	// name of the partition it was found in. ok is false if no partition
+	// knows how to route region.
+	Resolve(region string) (bucketURL string, partition string, ok bool)
+}
+
+// partitionResolver is the default, config-driven RegionResolver.
+type partitionResolver struct {
+	partitions []*Partition
+}
+
+// NewRegionResolver builds a RegionResolver from partition configuration
+// encoded as JSON or YAML.
+func NewRegionResolver(data []byte) (RegionResolver, error) {
+	var cfg regionsConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing region config: %w", err)
+	}
+	return newPartitionResolver(cfg.Partitions)
+}
+
+// newPartitionResolver compiles each partition's RegionRegex and builds a
+// partitionResolver over them. It is factored out of NewRegionResolver so
+// other config shapes that embed a []*Partition (e.g. BackendSelector's
+// combined backends+partitions file) can reuse the same region-matching
+// logic instead of re-implementing it.
+func newPartitionResolver(partitions []*Partition) (*partitionResolver, error) {
+	for _, p := range partitions {
+		if p.RegionRegex == "" {
+			continue
+		}
+		re, err := regexp.Compile(p.RegionRegex)
+		if err != nil {
+			return nil, fmt.Errorf("compiling regionRegex %q for partition %q: %w", p.RegionRegex, p.Name, err)
+		}
+		p.regionRegex = re
+	}
+	return &partitionResolver{partitions: partitions}, nil
+}
+
+// NewRegionResolverFromFile loads partition configuration from a JSON or
+// YAML file on disk, letting operators add, remove or reorder buckets
+// without recompiling archeio.
+func NewRegionResolverFromFile(path string) (RegionResolver, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading region config %q: %w", path, err)
+	}
+	return NewRegionResolver(data)
+}
+
+func (r *partitionResolver) Resolve(region string) (string, string, bool) {
+	for _, p := range r.partitions {
+		if p.regionRegex != nil && !p.regionRegex.MatchString(region) {
+			continue
+		}
+
+		if url, ok := p.bucketForRegion(region); ok {
+			return url, p.Name, true
+		}
+
+		if (region == "" || region == "GLOBAL") && p.ImplicitGlobalRegion != "" {
+			if url, ok := p.bucketForRegion(p.ImplicitGlobalRegion); ok {
+				return url, p.Name, true
+			}
+		}
+
+		if p.DefaultBucketRegion != "" {
+			if url, ok := p.bucketForRegion(p.DefaultBucketRegion); ok {
+				return url, p.Name, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// bucketForRegion returns the bucket URL that directly owns region, or that
+// lists region among its mappedRegions.
+func (p *Partition) bucketForRegion(region string) (string, bool) {
+	for _, b := range p.Buckets {
+		if b.Region == region {
+			return b.BucketURL, true
+		}
+		for _, mapped := range b.MappedRegions {
+			if mapped == region {
+				return b.BucketURL, true
+			}
+		}
+	}
+	return "", false
+}
+
+// BucketLister is implemented by RegionResolvers that can enumerate every
+// bucket they know about, grouped by partition, and that can order a
+// partition's buckets by estimated proximity to a client region. RegionRouter
+// uses this to health-probe buckets and to pick the nearest healthy failover
+// candidate within a partition.
+type BucketLister interface {
+	// Buckets returns, for each partition name, the bucket URLs configured
+	// in that partition, in preference order.
+	Buckets() map[string][]string
+	// FailoverOrder returns the bucket URLs in partition, ordered by
+	// estimated proximity to region (nearest first). An unknown partition
+	// returns nil.
+	FailoverOrder(partition, region string) []string
+}
+
+func (r *partitionResolver) Buckets() map[string][]string {
+	out := make(map[string][]string, len(r.partitions))
+	for _, p := range r.partitions {
+		urls := make([]string, 0, len(p.Buckets))
+		for _, b := range p.Buckets {
+			urls = append(urls, b.BucketURL)
+		}
+		out[p.Name] = urls
+	}
+	return out
+}
+
+func (r *partitionResolver) FailoverOrder(partition, region string) []string {
+	for _, p := range r.partitions {
+		if p.Name == partition {
+			return p.failoverOrder(region)
+		}
+	}
+	return nil
+}
+
+// failoverOrder returns this partition's bucket URLs ordered by estimated
+// proximity to region: buckets that themselves serve a region sharing
+// region's continent code (the part of a region name before its first
+// "-", e.g. "eu", "us", "ap") sort first, in configured order, followed by
+// the remaining buckets, also in configured order.
+func (p *Partition) failoverOrder(region string) []string {
+	continent := regionContinent(region)
+
+	var near, far []string
+	for _, b := range p.Buckets {
+		if regionContinent(b.Region) == continent {
+			near = append(near, b.BucketURL)
+		} else {
+			far = append(far, b.BucketURL)
+		}
+	}
+	return append(near, far...)
+}
+
+// regionContinent returns the part of a region name before its first "-",
+// used as a cheap proxy for physical proximity (e.g. "eu-west-1" and
+// "eu-central-1" are both "eu").
+func regionContinent(region string) string {
+	if idx := strings.Index(region, "-"); idx >= 0 {
+		return region[:idx]
+	}
+	return region
+}
+
+var (
+	defaultResolverOnce sync.Once
+	defaultResolver     RegionResolver
+	defaultResolverErr  error
+)
+
+// DefaultRegionResolver returns the process-wide RegionResolver: the file
+// named by ARCHEIO_REGIONS_CONFIG if set, otherwise the embedded default
+// mapping.
+func DefaultRegionResolver() (RegionResolver, error) {
+	defaultResolverOnce.Do(func() {
+		if path := os.Getenv("ARCHEIO_REGIONS_CONFIG"); path != "" {
+			defaultResolver, defaultResolverErr = NewRegionResolverFromFile(path)
+			return
+		}
+		defaultResolver, defaultResolverErr = NewRegionResolver(defaultRegionsConfig)
+	})
+	return defaultResolver, defaultResolverErr
+}
+
+// awsRegionToS3URL returns the base S3 bucket URL for an OCI layer blob given
+// the AWS region, resolving it via the configured RegionResolver.
+//
+// blobs in the buckets should be stored at /containers/images/sha256:$hash
+func awsRegionToS3URL(region string) string {
+	resolver, err := DefaultRegionResolver()
+	if err != nil {
+		klog.ErrorS(err, "failed to load region resolver")
+		return ""
+	}
+	url, _, ok := resolver.Resolve(region)
+	if !ok {
+		return ""
+	}
+	return url
+}
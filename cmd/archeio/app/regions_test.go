@@ -0,0 +1,66 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import "testing"
+
+const testRegionsConfig = `{
+  "partitions": [
+    {
+      "name": "aws",
+      "defaultBucketRegion": "us-east-1",
+      "buckets": [
+        {"region": "us-east-1", "bucketURL": "https://us-east-1.example.com"},
+        {"region": "eu-west-1", "bucketURL": "https://eu-west-1.example.com"},
+        {"region": "eu-central-1", "bucketURL": "https://eu-central-1.example.com"}
+      ]
+    }
+  ]
+}`
+
+func TestPartitionResolverFailoverOrderPrefersSameContinent(t *testing.T) {
+	resolver, err := NewRegionResolver([]byte(testRegionsConfig))
+	if err != nil {
+		t.Fatalf("NewRegionResolver() error = %v", err)
+	}
+	lister := resolver.(BucketLister)
+
+	order := lister.FailoverOrder("aws", "eu-west-1")
+	if len(order) != 3 {
+		t.Fatalf("expected 3 buckets in failover order, got %d: %v", len(order), order)
+	}
+	// the other eu-* bucket should be preferred over the us-east-1 bucket,
+	// even though us-east-1 is listed first in the config.
+	if order[0] != "https://eu-west-1.example.com" || order[1] != "https://eu-central-1.example.com" {
+		t.Errorf("expected eu buckets to sort before us-east-1, got %v", order)
+	}
+	if order[2] != "https://us-east-1.example.com" {
+		t.Errorf("expected us-east-1 last, got %v", order)
+	}
+}
+
+func TestPartitionResolverFailoverOrderUnknownPartition(t *testing.T) {
+	resolver, err := NewRegionResolver([]byte(testRegionsConfig))
+	if err != nil {
+		t.Fatalf("NewRegionResolver() error = %v", err)
+	}
+	lister := resolver.(BucketLister)
+
+	if order := lister.FailoverOrder("does-not-exist", "eu-west-1"); order != nil {
+		t.Errorf("expected nil order for an unknown partition, got %v", order)
+	}
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"golang.org/x/sync/singleflight"
+	"k8s.io/klog/v2"
+)
+
+// listPrefixHexLen is how many hex characters of the digest we list on, so
+// that one ListObjectsV2 call discovers every nearby layer of a multi-layer
+// image pull rather than just the one blob being checked.
+const listPrefixHexLen = 4
+
+// s3ListBlobChecker checks blob existence by issuing an S3 ListObjectsV2
+// against a short prefix of the digest, rather than a HEAD per blob. Every
+// key returned by the list is populated into the shared blobCache, so a
+// single list call amortizes across the many HEADs a cold image pull would
+// otherwise issue.
+type s3ListBlobChecker struct {
+	client *s3.Client
+	blobCache
+	group singleflight.Group
+}
+
+// NewS3ListBlobChecker returns a BlobChecker that resolves cache misses by
+// listing objects under the blob's digest prefix in the bucket passed to
+// BlobExists. The bucket argument is not used.
+func NewS3ListBlobChecker(cfg aws.Config, bucket string) BlobChecker {
+	return newS3ListBlobCheckerFromClient(s3.NewFromConfig(cfg))
+}
+
+// newS3ListBlobCheckerFromClient builds an s3ListBlobChecker around an
+// already-configured S3 client, letting callers (e.g. BlobCheckerFor) point
+// it at a non-AWS, S3-compatible endpoint.
+func newS3ListBlobCheckerFromClient(client *s3.Client) BlobChecker {
+	return &s3ListBlobChecker{
+		client:    client,
+		blobCache: newBlobCache(CachedBlobCheckerConfig{}.withDefaults()),
+	}
+}
+
+func (c *s3ListBlobChecker) BlobExists(blobURL, bucket, layerHash string) bool {
+	if exists, negative := c.blobCache.Get(bucket, layerHash); negative {
+		klog.V(3).InfoS("blob existence negative cache hit", "url", blobURL)
+		blobCacheNegativeHits.Inc()
+		return false
+	} else if exists {
+		klog.V(3).InfoS("blob existence cache hit", "url", blobURL)
+		blobCacheHits.Inc()
+		return true
+	}
+
+	klog.V(3).InfoS("blob existence cache miss, listing bucket", "url", blobURL)
+	blobCacheMisses.Inc()
+
+	prefix := blobListPrefix(layerHash)
+	_, err, shared := c.group.Do(bucket+"/"+prefix, func() (interface{}, error) {
+		return nil, c.listAndCache(context.Background(), bucket, prefix)
+	})
+	if shared {
+		blobCacheSingleflightShared.Inc()
+	}
+	if err != nil {
+		// a failed list (throttling, network blip, credentials issue, ...)
+		// tells us nothing about whether the blob exists, so don't memoize
+		// it as absent: that would turn a transient infrastructure failure
+		// into a confirmed-missing result for the rest of the negative TTL.
+		// Fall through and let the next check retry the list from scratch.
+		klog.ErrorS(err, "failed to list bucket for blob existence check", "url", blobURL, "bucket", bucket, "prefix", prefix)
+		return false
+	}
+
+	exists, _ := c.blobCache.Get(bucket, layerHash)
+	if !exists {
+		// the list succeeded but didn't surface this blob; cache the
+		// negative result directly so a repeat miss for the same blob
+		// doesn't re-list
+		c.blobCache.PutNegative(bucket, layerHash)
+	}
+	return exists
+}
+
+// listAndCache lists objects in bucket under prefix, populating the
+// blobCache with every key the list returns.
+func (c *s3ListBlobChecker) listAndCache(ctx context.Context, bucket, prefix string) error {
+	paginator := s3.NewListObjectsV2Paginator(c.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("listing objects in bucket %q with prefix %q: %w", bucket, prefix, err)
+		}
+		for _, obj := range page.Contents {
+			layerHash := strings.TrimPrefix(aws.ToString(obj.Key), "containers/images/")
+			c.blobCache.PutPositive(bucket, layerHash)
+		}
+	}
+	return nil
+}
+
+// blobListPrefix returns the S3 key prefix to list for layerHash, e.g.
+// "containers/images/sha256:abcd" for layerHash "sha256:abcdefgh...".
+func blobListPrefix(layerHash string) string {
+	hash := layerHash
+	if idx := strings.Index(hash, ":"); idx >= 0 {
+		algo, hex := hash[:idx], hash[idx+1:]
+		if len(hex) > listPrefixHexLen {
+			hex = hex[:listPrefixHexLen]
+		}
+		return "containers/images/" + algo + ":" + hex
+	}
+	if len(hash) > listPrefixHexLen {
+		hash = hash[:listPrefixHexLen]
+	}
+	return "containers/images/" + hash
+}
+
+// BlobCheckerConfig selects and configures the BlobChecker implementation
+// used for blob existence checks.
+type BlobCheckerConfig struct {
+	// Strategy is "head" (the default, one HTTP HEAD per blob) or "s3-list"
+	// (an S3 ListObjectsV2 prefix scan that warms the cache in bulk).
+	Strategy string
+	// HTTPClient is used by the "head" strategy.
+	HTTPClient *http.Client
+	// AWSConfig and Bucket are required by the "s3-list" strategy.
+	AWSConfig aws.Config
+	Bucket    string
+	// Cache configures the shared positive/negative cache.
+	Cache CachedBlobCheckerConfig
+}
+
+// NewBlobCheckerFromConfig builds the BlobChecker selected by cfg.Strategy.
+func NewBlobCheckerFromConfig(cfg BlobCheckerConfig) (BlobChecker, error) {
+	switch cfg.Strategy {
+	case "", "head":
+		httpClient := cfg.HTTPClient
+		if httpClient == nil {
+			httpClient = http.DefaultClient
+		}
+		return NewCachedBlobChecker(httpClient, cfg.Cache), nil
+	case "s3-list":
+		if cfg.Bucket == "" {
+			return nil, fmt.Errorf("bucket is required for the s3-list BlobChecker strategy")
+		}
+		checker := NewS3ListBlobChecker(cfg.AWSConfig, cfg.Bucket).(*s3ListBlobChecker)
+		checker.blobCache = newBlobCache(cfg.Cache.withDefaults())
+		return checker, nil
+	default:
+		return nil, fmt.Errorf("unknown blob checker strategy %q", cfg.Strategy)
+	}
+}
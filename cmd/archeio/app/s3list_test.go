@@ -0,0 +1,150 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestBlobListPrefix(t *testing.T) {
+	cases := []struct {
+		layerHash string
+		want      string
+	}{
+		{"sha256:abcdefabcdef", "containers/images/sha256:abcd"},
+		{"sha256:ab", "containers/images/sha256:ab"},
+		{"nocolonhash1234", "containers/images/noco"},
+	}
+	for _, c := range cases {
+		if got := blobListPrefix(c.layerHash); got != c.want {
+			t.Errorf("blobListPrefix(%q) = %q, want %q", c.layerHash, got, c.want)
+		}
+	}
+}
+
+// pagedListObjectsV2Server serves a two-page ListObjectsV2 response, so that
+// tests can verify the paginator follows NextContinuationToken.
+func pagedListObjectsV2Server(t *testing.T) *httptest.Server {
+	t.Helper()
+	const page1 = `<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">
+  <Name>test-bucket</Name>
+  <IsTruncated>true</IsTruncated>
+  <NextContinuationToken>page2</NextContinuationToken>
+  <Contents><Key>containers/images/sha256:aaaa1111</Key><Size>1</Size></Contents>
+  <Contents><Key>containers/images/sha256:aaaa2222</Key><Size>1</Size></Contents>
+</ListBucketResult>`
+	const page2 = `<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">
+  <Name>test-bucket</Name>
+  <IsTruncated>false</IsTruncated>
+  <Contents><Key>containers/images/sha256:aaaa3333</Key><Size>1</Size></Contents>
+</ListBucketResult>`
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		if r.URL.Query().Get("continuation-token") == "page2" {
+			fmt.Fprint(w, page2)
+			return
+		}
+		fmt.Fprint(w, page1)
+	}))
+}
+
+func newTestS3Client(endpoint string) *s3.Client {
+	cfg := aws.Config{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("test", "test", ""),
+	}
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.BaseEndpoint = aws.String(endpoint)
+		o.UsePathStyle = true
+	})
+}
+
+func TestS3ListBlobCheckerListAndCache(t *testing.T) {
+	server := pagedListObjectsV2Server(t)
+	defer server.Close()
+
+	checker := &s3ListBlobChecker{
+		client:    newTestS3Client(server.URL),
+		blobCache: newBlobCache(CachedBlobCheckerConfig{}.withDefaults()),
+	}
+
+	if err := checker.listAndCache(context.Background(), "test-bucket", "containers/images/sha256:aaaa"); err != nil {
+		t.Fatalf("listAndCache() error = %v", err)
+	}
+
+	for _, layerHash := range []string{"sha256:aaaa1111", "sha256:aaaa2222", "sha256:aaaa3333"} {
+		if exists, _ := checker.blobCache.Get("test-bucket", layerHash); !exists {
+			t.Errorf("expected %q to be cached after listing both pages", layerHash)
+		}
+	}
+}
+
+func TestS3ListBlobCheckerBlobExists(t *testing.T) {
+	server := pagedListObjectsV2Server(t)
+	defer server.Close()
+
+	checker := newS3ListBlobCheckerFromClient(newTestS3Client(server.URL))
+
+	if !checker.BlobExists("ignored", "test-bucket", "sha256:aaaa2222") {
+		t.Fatalf("expected sha256:aaaa2222 to exist after the list scan warms the cache")
+	}
+	if checker.BlobExists("ignored", "test-bucket", "sha256:ffffffff") {
+		t.Fatalf("expected sha256:ffffffff to be absent")
+	}
+}
+
+// erroringListObjectsV2Server always answers ListObjectsV2 with a
+// throttling-style S3 error, to exercise BlobExists's handling of a failed
+// list rather than a list that legitimately didn't contain the blob.
+func erroringListObjectsV2Server(t *testing.T) *httptest.Server {
+	t.Helper()
+	const errorBody = `<?xml version="1.0" encoding="UTF-8"?>
+<Error>
+  <Code>SlowDown</Code>
+  <Message>Please reduce your request rate.</Message>
+</Error>`
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, errorBody)
+	}))
+}
+
+func TestS3ListBlobCheckerBlobExistsDoesNotCacheTransientListFailureAsNegative(t *testing.T) {
+	server := erroringListObjectsV2Server(t)
+	defer server.Close()
+
+	checker := newS3ListBlobCheckerFromClient(newTestS3Client(server.URL)).(*s3ListBlobChecker)
+
+	if checker.BlobExists("ignored", "test-bucket", "sha256:aaaa1111") {
+		t.Fatalf("expected BlobExists to report false when the underlying list call fails")
+	}
+	if _, negative := checker.blobCache.Get("test-bucket", "sha256:aaaa1111"); negative {
+		t.Errorf("expected a failed list not to be memoized as a confirmed-absent blob")
+	}
+}